@@ -16,9 +16,13 @@
 package harness
 
 import (
+	"container/list"
 	"context"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"math/rand"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -28,6 +32,7 @@ import (
 	"github.com/apache/beam/sdks/go/pkg/beam/log"
 	pb "github.com/apache/beam/sdks/go/pkg/beam/model/fnexecution_v1"
 	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
 )
 
 // ScopedStateReader scopes the global gRPC state manager to a single instruction
@@ -35,6 +40,13 @@ import (
 type ScopedStateReader struct {
 	mgr    *StateChannelManager
 	instID string
+	tokens []CacheToken
+	cache  *stateCache
+
+	// PrefetchWindow caps how many segments of a continuation chain
+	// stateKeyReaders opened through this instance fetch ahead of the
+	// consumer. Zero uses defaultPrefetchWindow.
+	PrefetchWindow int
 
 	opened []io.Closer // track open readers to force close all
 	closed bool
@@ -42,8 +54,14 @@ type ScopedStateReader struct {
 }
 
 // NewScopedStateReader returns a ScopedStateReader for the given instruction.
-func NewScopedStateReader(mgr *StateChannelManager, instID string) *ScopedStateReader {
-	return &ScopedStateReader{mgr: mgr, instID: instID}
+// tokens are the cache tokens the runner handed the SDK for this bundle, as
+// found in the ProcessBundleRequest; they let repeated reads of unchanged
+// state (e.g. a broadcast side input) be served from the process-wide state
+// cache instead of being re-fetched from the runner.
+func NewScopedStateReader(mgr *StateChannelManager, instID string, tokens ...CacheToken) *ScopedStateReader {
+	cache := mgr.stateCache()
+	cache.updateTokens(tokens)
+	return &ScopedStateReader{mgr: mgr, instID: instID, tokens: tokens, cache: cache}
 }
 
 // OpenSideInput opens a byte stream for reading iterable side input.
@@ -60,6 +78,71 @@ func (s *ScopedStateReader) OpenIterable(ctx context.Context, id exec.StreamID,
 	})
 }
 
+// OpenBagUserStateReader opens a byte stream for reading the bag user state
+// held by the runner for the given user state id, key and window.
+func (s *ScopedStateReader) OpenBagUserStateReader(ctx context.Context, id exec.StreamID, userStateID string, key, w []byte) (io.ReadCloser, error) {
+	return s.openReader(ctx, id, func(ch *StateChannel) *stateKeyReader {
+		return newBagUserStateReader(ch, id, userStateID, s.instID, key, w)
+	})
+}
+
+// OpenBagUserStateAppender opens a byte stream for appending to the bag user
+// state held by the runner for the given user state id, key and window.
+// Appended bytes are buffered and only sent to the runner when the writer
+// is flushed or closed.
+func (s *ScopedStateReader) OpenBagUserStateAppender(ctx context.Context, id exec.StreamID, userStateID string, key, w []byte) (io.WriteCloser, error) {
+	ch, err := s.open(ctx, id.Port)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, errors.Errorf("instruction %v no longer processing", s.instID)
+	}
+	ret := newBagUserStateWriter(ch, id, userStateID, s.instID, key, w)
+	ret.cache = s.cache
+	ret.cacheToken = resolveCacheToken(s.tokens, ret.key)
+	s.opened = append(s.opened, ret)
+	s.mu.Unlock()
+	return ret, nil
+}
+
+// ClearBagUserState clears the bag user state held by the runner for the
+// given user state id, key and window.
+func (s *ScopedStateReader) ClearBagUserState(ctx context.Context, id exec.StreamID, userStateID string, key, w []byte) error {
+	ch, err := s.open(ctx, id.Port)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return errors.Errorf("instruction %v no longer processing", s.instID)
+	}
+	instID := s.instID
+	s.mu.Unlock()
+
+	stateKey := bagUserStateKey(id, userStateID, key, w)
+	req := &pb.StateRequest{
+		InstructionId: instID,
+		StateKey:      stateKey,
+		Request: &pb.StateRequest_Clear{
+			Clear: &pb.StateClearRequest{},
+		},
+	}
+	if _, err = ch.Send(req); err != nil {
+		return err
+	}
+	// The runner's copy of this bag is now empty; drop any cached read of it
+	// so a subsequent OpenBagUserStateReader in this bundle doesn't serve
+	// stale pre-clear segments.
+	s.cache.invalidate(stateKey, resolveCacheToken(s.tokens, stateKey))
+	return nil
+}
+
 func (s *ScopedStateReader) openReader(ctx context.Context, id exec.StreamID, readerFn func(*StateChannel) *stateKeyReader) (*stateKeyReader, error) {
 	ch, err := s.open(ctx, id.Port)
 	if err != nil {
@@ -72,6 +155,9 @@ func (s *ScopedStateReader) openReader(ctx context.Context, id exec.StreamID, re
 		return nil, errors.Errorf("instruction %v no longer processing", s.instID)
 	}
 	ret := readerFn(ch)
+	ret.cache = s.cache
+	ret.cacheToken = resolveCacheToken(s.tokens, ret.key)
+	ret.prefetchWindow = s.PrefetchWindow
 	s.opened = append(s.opened, ret)
 	s.mu.Unlock()
 	return ret, nil
@@ -110,11 +196,41 @@ type stateKeyReader struct {
 	buf   []byte
 	eof   bool
 
+	// cache and cacheToken, if cacheToken is non-nil, let Read serve the
+	// whole segment chain for key from the process-wide state cache instead
+	// of issuing StateRequest_Get calls.
+	cache        *stateCache
+	cacheToken   []byte
+	cacheChecked bool
+	cacheSegs    [][]byte
+	cacheIdx     int
+	segments     [][]byte // segments fetched so far, kept to populate the cache once read in full
+
+	// prefetchWindow bounds how many segments the background fetcher below
+	// is allowed to run ahead of Read. 0 means defaultPrefetchWindow.
+	// prefetch and prefetchDone are created at most once, under mu, by
+	// startPrefetch -- guarding their creation there (rather than via
+	// sync.Once) lets Close observe and close a not-yet-created
+	// prefetchDone atomically with respect to it, instead of racing with
+	// startPrefetch to decide whether a fetcher will be launched at all.
+	prefetchWindow int
+	prefetch       chan fetchedSegment // lazily started; buffered to prefetchWindow
+	prefetchDone   chan struct{}       // closed by Close to stop the fetcher
+
 	ch     *StateChannel
 	closed bool
 	mu     sync.Mutex
 }
 
+// fetchedSegment is one StateGetResponse page, normalized for stateKeyReader
+// to consume regardless of whether it came from the cache or the runner.
+type fetchedSegment struct {
+	data  []byte
+	token []byte // continuation token for the segment after this one, if any
+	eof   bool   // true if this key has no data at all
+	err   error
+}
+
 func newSideInputReader(ch *StateChannel, id exec.StreamID, sideInputID string, instID string, k, w []byte) *stateKeyReader {
 	key := &pb.StateKey{
 		Type: &pb.StateKey_MultimapSideInput_{
@@ -148,13 +264,35 @@ func newRunnerReader(ch *StateChannel, instID string, k []byte) *stateKeyReader
 	}
 }
 
+func newBagUserStateReader(ch *StateChannel, id exec.StreamID, userStateID string, instID string, k, w []byte) *stateKeyReader {
+	return &stateKeyReader{
+		instID: instID,
+		key:    bagUserStateKey(id, userStateID, k, w),
+		ch:     ch,
+	}
+}
+
+func bagUserStateKey(id exec.StreamID, userStateID string, k, w []byte) *pb.StateKey {
+	return &pb.StateKey{
+		Type: &pb.StateKey_BagUserState_{
+			BagUserState: &pb.StateKey_BagUserState{
+				TransformId: id.PtransformID,
+				UserStateId: userStateID,
+				Window:      w,
+				Key:         k,
+			},
+		},
+	}
+}
+
 func (r *stateKeyReader) Read(buf []byte) (int, error) {
 	if r.buf == nil {
 		if r.eof {
 			return 0, io.EOF
 		}
 
-		// Buffer empty. Get next segment.
+		// Buffer empty. Get next segment, either from the state cache or
+		// the runner.
 
 		r.mu.Lock()
 		if r.closed {
@@ -164,30 +302,65 @@ func (r *stateKeyReader) Read(buf []byte) (int, error) {
 		local := r.ch
 		r.mu.Unlock()
 
-		req := &pb.StateRequest{
-			// Id: set by channel
-			InstructionId: r.instID,
-			StateKey:      r.key,
-			Request: &pb.StateRequest_Get{
-				Get: &pb.StateGetRequest{
-					ContinuationToken: r.token,
-				},
-			},
+		if !r.cacheChecked {
+			r.cacheChecked = true
+			if segs, ok := r.cache.get(r.key, r.cacheToken); ok {
+				if len(segs) == 0 {
+					r.eof = true // the cached chain is empty.
+					return 0, io.EOF
+				}
+				r.cacheSegs = segs
+			}
 		}
-		resp, err := local.Send(req)
-		if err != nil {
-			return 0, err
+
+		if r.cacheSegs != nil {
+			if r.cacheIdx >= len(r.cacheSegs) {
+				r.eof = true
+				return 0, io.EOF
+			}
+			r.buf = r.cacheSegs[r.cacheIdx]
+			r.cacheIdx++
+			if r.cacheIdx == len(r.cacheSegs) {
+				r.eof = true // the cached chain ends here.
+			}
+			n := copy(buf, r.buf)
+			if len(r.buf) == n {
+				r.buf = nil
+			} else {
+				r.buf = r.buf[n:]
+			}
+			return n, nil
 		}
-		get := resp.GetGet()
-		if get == nil { // no data associated with this segment.
+
+		prefetch, prefetchDone, ok := r.startPrefetch(local)
+		if !ok {
+			return 0, errors.New("side input closed")
+		}
+		var seg fetchedSegment
+		select {
+		case seg = <-prefetch:
+		case <-prefetchDone:
+			// Close raced startPrefetch: prefetchLoop saw prefetchDone fire
+			// while trying to hand off its segment (or never got to) and
+			// gave up without sending. Nothing will ever arrive on
+			// prefetch now.
+			return 0, errors.New("side input closed")
+		}
+		if seg.err != nil {
+			return 0, seg.err
+		}
+		if seg.eof { // no data associated with this segment.
 			r.eof = true
+			r.cache.put(r.key, r.cacheToken, r.segments)
 			return 0, io.EOF
 		}
-		r.token = get.GetContinuationToken()
-		r.buf = get.GetData()
+		r.token = seg.token
+		r.buf = seg.data
+		r.segments = append(r.segments, r.buf)
 
 		if r.token == nil {
 			r.eof = true // no token == this is the last segment.
+			r.cache.put(r.key, r.cacheToken, r.segments)
 		}
 	}
 
@@ -201,21 +374,460 @@ func (r *stateKeyReader) Read(buf []byte) (int, error) {
 	return n, nil
 }
 
+// defaultPrefetchWindow is the number of segments fetched ahead of the
+// consumer when no explicit prefetchWindow was configured.
+const defaultPrefetchWindow = 1
+
+// startPrefetch lazily launches the background fetch loop that pipelines
+// StateGetRequest calls for this key's continuation chain, so Read rarely
+// blocks on a fresh round trip once the pipeline is primed. ok is false if
+// the reader was already closed, in which case no fetcher is started and
+// the caller must not wait on prefetch. Otherwise the caller must select on
+// both prefetch and done, since Close can fire after startPrefetch returns
+// but before prefetchLoop delivers a segment, in which case nothing is ever
+// sent on prefetch.
+func (r *stateKeyReader) startPrefetch(ch *StateChannel) (prefetch chan fetchedSegment, done chan struct{}, ok bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return nil, nil, false
+	}
+	if r.prefetch == nil {
+		window := r.prefetchWindow
+		if window < 1 {
+			window = defaultPrefetchWindow
+		}
+		r.prefetch = make(chan fetchedSegment, window)
+		r.prefetchDone = make(chan struct{})
+		go r.prefetchLoop(ch)
+	}
+	return r.prefetch, r.prefetchDone, true
+}
+
+// prefetchLoop repeatedly fetches the next segment of the continuation
+// chain and parks it on r.prefetch, without waiting for Read to consume the
+// previous one -- up to the channel's buffered window. It transparently
+// retries a fetch that fails because the channel reconnected, using the
+// continuation token from the prior response.
+func (r *stateKeyReader) prefetchLoop(ch *StateChannel) {
+	token := r.token
+	for {
+		req := &pb.StateRequest{
+			InstructionId: r.instID,
+			StateKey:      r.key,
+			Request: &pb.StateRequest_Get{
+				Get: &pb.StateGetRequest{ContinuationToken: token},
+			},
+		}
+
+		resp, ok := r.fetchOne(ch, req)
+		if !ok {
+			return // told to stop: reader closed.
+		}
+
+		var seg fetchedSegment
+		switch {
+		case resp.Error != "":
+			seg.err = errors.New(resp.Error)
+		case resp.GetGet() == nil:
+			seg.eof = true
+		default:
+			seg.data = resp.GetGet().GetData()
+			seg.token = resp.GetGet().GetContinuationToken()
+		}
+
+		select {
+		case r.prefetch <- seg:
+		case <-r.prefetchDone:
+			return
+		}
+
+		if seg.err != nil || seg.eof || seg.token == nil {
+			return // chain exhausted or broken; nothing more to fetch.
+		}
+		token = seg.token
+	}
+}
+
+// fetchOne sends req asynchronously and waits for its response, retrying
+// transparently if the channel reports a disconnect. ok is false if
+// prefetchDone fired before a response arrived, meaning the caller should
+// stop without consuming resp.
+func (r *stateKeyReader) fetchOne(ch *StateChannel, req *pb.StateRequest) (resp *pb.StateResponse, ok bool) {
+	for retries := 0; ; retries++ {
+		respCh, cancel := ch.sendAsync(req)
+		select {
+		case resp = <-respCh:
+		case <-r.prefetchDone:
+			cancel()
+			return nil, false
+		}
+
+		if resp.Error != stateChannelDisconnected || retries >= maxStateReadRetries {
+			return resp, true
+		}
+		// The channel reconnected out from under us; req still carries the
+		// continuation token from the prior response, so resending it
+		// picks up exactly where we left off.
+		time.Sleep(stateReadRetryBackoff)
+	}
+}
+
 func (r *stateKeyReader) Close() error {
 	r.mu.Lock()
 	r.closed = true
 	r.ch = nil
+	done := r.prefetchDone
 	r.mu.Unlock()
+	if done != nil {
+		// Stop the background fetcher. Any request it has in flight is
+		// canceled from within fetchOne, so a late response isn't logged as
+		// an orphan. Reading prefetchDone under the same lock startPrefetch
+		// creates it under means Close can never run between
+		// startPrefetch's own check of r.closed and its channel creation --
+		// either
+		// startPrefetch observes closed and never launches a fetcher, or it
+		// finishes creating prefetchDone before Close sees it.
+		close(done)
+	}
+	return nil
+}
+
+// stateKeyWriter is the append-side sibling of stateKeyReader. It buffers
+// written bytes locally and only flushes them to the runner as a
+// StateAppendRequest once asked to, so that a DoFn can make many small
+// appends to a state cell without issuing a round trip for each of them.
+type stateKeyWriter struct {
+	instID string
+	key    *pb.StateKey
+
+	buf []byte
+
+	// cache and cacheToken, if cacheToken is non-nil, are invalidated after
+	// a successful flush, so a reader opened later in the same bundle
+	// doesn't serve segments cached before this append.
+	cache      *stateCache
+	cacheToken []byte
+
+	ch     *StateChannel
+	closed bool
+	mu     sync.Mutex
+}
+
+func newBagUserStateWriter(ch *StateChannel, id exec.StreamID, userStateID string, instID string, k, w []byte) *stateKeyWriter {
+	return &stateKeyWriter{
+		instID: instID,
+		key:    bagUserStateKey(id, userStateID, k, w),
+		ch:     ch,
+	}
+}
+
+// Write buffers p to be flushed on the next Close or Flush. It never blocks
+// on the state service.
+func (w *stateKeyWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, errors.New("state writer closed")
+	}
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+// Flush sends any buffered bytes to the runner as a single
+// StateAppendRequest, leaving the writer open for further appends.
+func (w *stateKeyWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return errors.New("state writer closed")
+	}
+	return w.flush()
+}
+
+// Close flushes any buffered bytes and closes the writer. Instructions must
+// close every writer they open so pending appends are guaranteed to reach
+// the runner before the instruction finalizes.
+func (w *stateKeyWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	err := w.flush()
+	w.closed = true
+	w.ch = nil
+	return err
+}
+
+// flush sends the buffered bytes, if any. Callers must hold w.mu.
+func (w *stateKeyWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	req := &pb.StateRequest{
+		InstructionId: w.instID,
+		StateKey:      w.key,
+		Request: &pb.StateRequest_Append{
+			Append: &pb.StateAppendRequest{
+				Data: w.buf,
+			},
+		},
+	}
+	w.buf = nil
+	if _, err := w.ch.Send(req); err != nil {
+		return err
+	}
+	w.cache.invalidate(w.key, w.cacheToken)
 	return nil
 }
 
+// CacheToken is a cache token the runner handed the SDK for the current
+// bundle, as found in the ProcessBundleRequest, scoped to either all bag
+// user state or a single side input.
+type CacheToken struct {
+	Token []byte
+
+	UserState            bool
+	SideInputTransformID string
+	SideInputID          string
+}
+
+func (t CacheToken) appliesTo(key *pb.StateKey) bool {
+	switch k := key.GetType().(type) {
+	case *pb.StateKey_BagUserState_:
+		return t.UserState
+	case *pb.StateKey_MultimapSideInput_:
+		return !t.UserState && t.SideInputTransformID == k.MultimapSideInput.GetTransformId() && t.SideInputID == k.MultimapSideInput.GetSideInputId()
+	default:
+		return false
+	}
+}
+
+// resolveCacheToken returns the token among tokens that is scoped to key, or
+// nil if the runner did not hand us one -- in which case the state for key
+// must not be cached across bundles.
+func resolveCacheToken(tokens []CacheToken, key *pb.StateKey) []byte {
+	for _, t := range tokens {
+		if t.appliesTo(key) {
+			return t.Token
+		}
+	}
+	return nil
+}
+
+// tokenScope identifies the logical resource a CacheToken is scoped to
+// (independent of the token's value), so a newer token for the same
+// resource can be recognized as superseding an older one.
+func tokenScope(t CacheToken) string {
+	if t.UserState {
+		return "user-state"
+	}
+	return "side-input\x00" + t.SideInputTransformID + "\x00" + t.SideInputID
+}
+
+// defaultStateCacheBudget bounds how many bytes of state segments the
+// per-process state cache retains across bundles.
+const defaultStateCacheBudget = 100 << 20 // 100 MB
+
+// CacheMetrics reports hit/miss counts for the state cache, so callers can
+// size the budget for their workload.
+type CacheMetrics struct {
+	Hits, Misses int64
+}
+
+// stateCache caches the segments of a StateGetResponse chain, keyed by the
+// requested StateKey and the cache token the runner gave it for the current
+// bundle. It implements a byte-budgeted LRU eviction policy: once the
+// budget is exceeded, the least-recently-used entries are dropped first.
+type stateCache struct {
+	mu     sync.Mutex
+	budget int
+	used   int
+	ll     *list.List
+	items  map[string]*list.Element
+
+	// scopes tracks the most recently seen cache token for each resource
+	// (see tokenScope), so updateTokens can tell a renewed token from one
+	// the runner has replaced.
+	scopes map[string]string
+
+	hits, misses int64
+}
+
+type stateCacheEntry struct {
+	key      string
+	token    string
+	segments [][]byte
+	size     int
+}
+
+func newStateCache(budget int) *stateCache {
+	return &stateCache{
+		budget: budget,
+		ll:     list.New(),
+		items:  make(map[string]*list.Element),
+		scopes: make(map[string]string),
+	}
+}
+
+// stateCacheKey builds a map key that uniquely identifies (key, token). The
+// token is an opaque, runner-supplied byte string -- it may itself contain
+// "\x00", as may the marshaled StateKey -- so simply concatenating the two
+// with a separator is ambiguous: (token="a\x00b", key="c") and (token="a",
+// key="b\x00c") would collide and serve one key's cached segments for
+// another, silently corrupting a stateful pipeline. Length-prefixing the
+// token makes the split point unambiguous regardless of its contents.
+func stateCacheKey(key *pb.StateKey, token []byte) string {
+	raw, _ := proto.Marshal(key)
+	var b strings.Builder
+	b.Grow(8 + len(token) + len(raw))
+	var lenBuf [8]byte
+	binary.BigEndian.PutUint64(lenBuf[:], uint64(len(token)))
+	b.Write(lenBuf[:])
+	b.Write(token)
+	b.Write(raw)
+	return b.String()
+}
+
+// get returns the cached segment chain for (key, token), if present. A nil
+// or empty token never hits, since an empty token means the runner did not
+// offer caching for this key.
+func (c *stateCache) get(key *pb.StateKey, token []byte) ([][]byte, bool) {
+	if c == nil || len(token) == 0 {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[stateCacheKey(key, token)]
+	if !ok {
+		atomic.AddInt64(&c.misses, 1)
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	atomic.AddInt64(&c.hits, 1)
+	return e.Value.(*stateCacheEntry).segments, true
+}
+
+// put stores the segment chain for (key, token), evicting the
+// least-recently-used entries until the cache is back under budget.
+func (c *stateCache) put(key *pb.StateKey, token []byte, segments [][]byte) {
+	if c == nil || len(token) == 0 {
+		return
+	}
+	size := 0
+	for _, s := range segments {
+		size += len(s)
+	}
+	k := stateCacheKey(key, token)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[k]; ok {
+		c.used -= e.Value.(*stateCacheEntry).size
+		c.ll.Remove(e)
+		delete(c.items, k)
+	}
+	c.items[k] = c.ll.PushFront(&stateCacheEntry{key: k, token: string(token), segments: segments, size: size})
+	c.used += size
+
+	for c.used > c.budget && c.ll.Len() > 0 {
+		back := c.ll.Back()
+		ent := back.Value.(*stateCacheEntry)
+		c.ll.Remove(back)
+		delete(c.items, ent.key)
+		c.used -= ent.size
+	}
+}
+
+// updateTokens reconciles the cache against the tokens a bundle was handed.
+// The cache is process-wide and bundles run concurrently with different
+// token sets, so this must not evict anything the current bundle simply
+// didn't mention -- another in-flight bundle may still rely on it. Instead,
+// for each token offered, it drops only the entries left behind by a prior,
+// now-superseded token for that same resource (see tokenScope), which is
+// the one case where the runner has told us a token was not renewed.
+func (c *stateCache) updateTokens(tokens []CacheToken) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, t := range tokens {
+		scope := tokenScope(t)
+		tok := string(t.Token)
+		if old, ok := c.scopes[scope]; ok && old != tok {
+			c.invalidateTokenLocked(old)
+		}
+		c.scopes[scope] = tok
+	}
+}
+
+// invalidateTokenLocked drops every cached entry stamped with token. Callers
+// must hold c.mu.
+func (c *stateCache) invalidateTokenLocked(token string) {
+	for k, e := range c.items {
+		ent := e.Value.(*stateCacheEntry)
+		if ent.token == token {
+			c.ll.Remove(e)
+			delete(c.items, k)
+			c.used -= ent.size
+		}
+	}
+}
+
+// invalidate drops the cached entry for (key, token), if any. Callers use
+// this after a write to key so a subsequent read in the same bundle
+// doesn't serve segments cached before the write.
+func (c *stateCache) invalidate(key *pb.StateKey, token []byte) {
+	if c == nil || len(token) == 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	k := stateCacheKey(key, token)
+	if e, ok := c.items[k]; ok {
+		ent := e.Value.(*stateCacheEntry)
+		c.ll.Remove(e)
+		delete(c.items, k)
+		c.used -= ent.size
+	}
+}
+
+// Metrics returns the current hit/miss counters.
+func (c *stateCache) Metrics() CacheMetrics {
+	if c == nil {
+		return CacheMetrics{}
+	}
+	return CacheMetrics{Hits: atomic.LoadInt64(&c.hits), Misses: atomic.LoadInt64(&c.misses)}
+}
+
+// CacheMetrics returns the hit/miss counters for the state cache backing
+// this reader's bundle.
+func (s *ScopedStateReader) CacheMetrics() CacheMetrics {
+	return s.cache.Metrics()
+}
+
 // StateChannelManager manages data channels over the State API. A fixed number of channels
 // are generally used, each managing multiple logical byte streams. Thread-safe.
 type StateChannelManager struct {
 	ports map[string]*StateChannel
+	cache *stateCache
 	mu    sync.Mutex
 }
 
+// stateCache returns the process-wide state cache shared by all bundles,
+// creating it on first use.
+func (m *StateChannelManager) stateCache() *stateCache {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.cache == nil {
+		m.cache = newStateCache(defaultStateCacheBudget)
+	}
+	return m.cache
+}
+
 // Open opens a R/W StateChannel over the given port.
 func (m *StateChannelManager) Open(ctx context.Context, port exec.Port) (*StateChannel, error) {
 	m.mu.Lock()
@@ -236,111 +848,465 @@ func (m *StateChannelManager) Open(ctx context.Context, port exec.Port) (*StateC
 	return ch, nil
 }
 
+// Shutdown tears down every StateChannel this manager has opened, so their
+// supervise/read/write goroutines don't leak past the worker's lifetime.
+func (m *StateChannelManager) Shutdown() {
+	m.mu.Lock()
+	ports := m.ports
+	m.ports = nil
+	m.mu.Unlock()
+
+	for _, ch := range ports {
+		ch.shutdown()
+	}
+}
+
+const (
+	// maxStateReadRetries bounds how many times stateKeyReader.Read retries
+	// a segment fetch after a channel disconnect, so a permanently broken
+	// channel still surfaces an error instead of looping forever.
+	maxStateReadRetries = 50
+	// stateReadRetryBackoff is the pause between those retries.
+	stateReadRetryBackoff = 100 * time.Millisecond
+
+	// stateChannelMinBackoff and stateChannelMaxBackoff bound the delay
+	// between reconnect attempts once the underlying stream has failed.
+	stateChannelMinBackoff = 100 * time.Millisecond
+	stateChannelMaxBackoff = 5 * time.Second
+
+	// defaultStateSendTimeout bounds how long Send waits for a response
+	// before giving up, so a wedged runner can't block a bundle forever.
+	defaultStateSendTimeout = 30 * time.Second
+
+	// stateChannelDisconnected is the synthetic error message used to fail
+	// in-flight requests when the stream breaks. stateKeyReader recognizes
+	// it and retries its request transparently once reconnected.
+	stateChannelDisconnected = "state channel disconnected, reconnecting"
+
+	// stateChannelShutdown is the synthetic error message used to fail any
+	// request still pending once the channel has been shut down for good.
+	stateChannelShutdown = "state channel shut down"
+)
+
 // StateChannel manages state transactions over a single gRPC connection.
 // It does not need to track readers and writers as carefully as the
 // DataChannel, because the state protocol is request-based.
+//
+// A supervising goroutine owns the lifetime of the underlying stream: if
+// Recv or Send reports an error, it fails every in-flight request and
+// re-dials the state service with exponential backoff before resuming
+// service. A request failed this way reaches Send's caller as an error (see
+// stateChannelDisconnected); stateKeyReader retries such a request
+// transparently.
 type StateChannel struct {
-	id     string
-	client pb.BeamFnState_StateClient
+	id   string
+	port exec.Port
+
+	sendTimeout time.Duration
 
 	requests      chan *pb.StateRequest
 	nextRequestNo int32
 
-	responses map[string]chan<- *pb.StateResponse
-	mu        sync.Mutex
+	mu         sync.Mutex
+	client     pb.BeamFnState_StateClient
+	cc         *grpc.ClientConn
+	ready      chan struct{} // closed and replaced each time a new stream becomes ready
+	generation int64         // bumped each time connect installs a new stream
+	responses  map[string]chan<- *pb.StateResponse
+	closed     bool // set by shutdown, before requests is closed
+
+	broken  chan int64 // signals the stream for a generation appears dead
+	orphans int64      // count of responses delivered for a request no one is waiting on
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup // tracks write(), so shutdown can wait for it to drain
 }
 
 func newStateChannel(ctx context.Context, port exec.Port) (*StateChannel, error) {
-	cc, err := dial(ctx, port.URL, 15*time.Second)
+	ctx, cancel := context.WithCancel(ctx)
+
+	ret := &StateChannel{
+		id:          port.URL,
+		port:        port,
+		sendTimeout: defaultStateSendTimeout,
+		requests:    make(chan *pb.StateRequest, 10),
+		responses:   make(map[string]chan<- *pb.StateResponse),
+		ready:       make(chan struct{}),
+		broken:      make(chan int64, 1),
+		cancel:      cancel,
+	}
+
+	if err := ret.connect(ctx); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	go ret.supervise(ctx)
+	ret.wg.Add(1)
+	go ret.write(ctx)
+
+	return ret, nil
+}
+
+// SetSendTimeout overrides the default timeout Send waits for a response.
+func (c *StateChannel) SetSendTimeout(d time.Duration) {
+	c.mu.Lock()
+	c.sendTimeout = d
+	c.mu.Unlock()
+}
+
+// connect dials the state service, swaps in the new client and starts a
+// read loop for it, waking up any writer blocked in awaitReconnect.
+func (c *StateChannel) connect(ctx context.Context) error {
+	cc, err := dial(ctx, c.port.URL, 15*time.Second)
 	if err != nil {
-		return nil, errors.Wrapf(err, "failed to connect to state service %v", port.URL)
+		return errors.Wrapf(err, "failed to connect to state service %v", c.port.URL)
 	}
 	client, err := pb.NewBeamFnStateClient(cc).State(ctx)
 	if err != nil {
 		cc.Close()
-		return nil, errors.Wrapf(err, "failed to create state client %v", port.URL)
+		return errors.Wrapf(err, "failed to create state client %v", c.port.URL)
 	}
 
-	ret := &StateChannel{
-		id:        port.URL,
-		client:    client,
-		requests:  make(chan *pb.StateRequest, 10),
-		responses: make(map[string]chan<- *pb.StateResponse),
+	c.mu.Lock()
+	if c.cc != nil {
+		c.cc.Close()
 	}
-	go ret.read(ctx)
-	go ret.write(ctx)
+	c.cc = cc
+	c.client = client
+	c.generation++
+	gen := c.generation
+	ready := c.ready
+	c.ready = make(chan struct{})
+	c.mu.Unlock()
 
-	return ret, nil
+	close(ready)
+	go c.read(ctx, client, gen)
+	return nil
 }
 
-func (c *StateChannel) read(ctx context.Context) {
+// jitter returns a random duration in [d/2, d), so channels that failed
+// around the same time (e.g. a runner restart taking down every stream at
+// once) don't all retry in lockstep and hammer the state service the
+// moment it comes back.
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(d-half)))
+}
+
+// supervise reconnects the channel with exponential backoff whenever read
+// or write observes the stream has failed.
+func (c *StateChannel) supervise(ctx context.Context) {
 	for {
-		msg, err := c.client.Recv()
-		if err != nil {
-			if err == io.EOF {
-				// TODO(herohde) 10/12/2017: can this happen before shutdown? Reconnect?
-				log.Warnf(ctx, "StateChannel[%v].read: closed", c.id)
-				return
-			}
-			log.Errorf(ctx, "StateChannel[%v].read bad: %v", c.id, err)
+		select {
+		case <-ctx.Done():
 			return
-		}
+		case gen := <-c.broken:
+			c.mu.Lock()
+			current := c.generation
+			c.mu.Unlock()
+			if gen < current {
+				// Stale: read and write both observed the same disconnect
+				// and each signals independently, but by the time this one
+				// was handled the stream had already been replaced. Acting
+				// on it would tear down the newly-established, healthy
+				// stream for no reason.
+				continue
+			}
+			c.failPending(stateChannelDisconnected)
 
-		c.mu.Lock()
-		ch, ok := c.responses[msg.Id]
-		delete(c.responses, msg.Id)
-		c.mu.Unlock()
-		if !ok {
-			// This can happen if Send returns an error that write handles, but
-			// the message was actually sent.
-			log.Errorf(ctx, "StateChannel[%v].read: no consumer for state response: %v", c.id, proto.MarshalTextString(msg))
-			continue
+			// Retries are bounded by ctx, not a fixed deadline: ctx is the
+			// worker's own lifetime, supplied by the harness, so a state
+			// service that never comes back simply retries for as long as
+			// the worker itself is still up -- there is no shorter horizon
+			// that would be meaningful here, since giving up early would
+			// just strand every in-flight bundle that needs this channel.
+			backoff := stateChannelMinBackoff
+			for {
+				if ctx.Err() != nil {
+					return
+				}
+				if err := c.connect(ctx); err == nil {
+					break
+				} else {
+					log.Warnf(ctx, "StateChannel[%v]: reconnect failed, retrying in %v: %v", c.id, backoff, err)
+				}
+
+				select {
+				case <-time.After(jitter(backoff)):
+				case <-ctx.Done():
+					return
+				}
+				if backoff *= 2; backoff > stateChannelMaxBackoff {
+					backoff = stateChannelMaxBackoff
+				}
+			}
 		}
+	}
+}
+
+// signalBroken notifies the supervisor the stream for gen appears dead. It
+// never blocks, and keeps at most the most recent generation buffered: read
+// and write each detect the same disconnect independently, so a pending
+// signal is replaced rather than left to go stale once supervise has
+// already reconnected past it.
+func (c *StateChannel) signalBroken(gen int64) {
+	select {
+	case c.broken <- gen:
+		return
+	default:
+	}
+	select {
+	case <-c.broken:
+	default:
+	}
+	select {
+	case c.broken <- gen:
+	default:
+	}
+}
+
+// failPending delivers a synthetic error response to every request still
+// awaiting one, so no Send call blocks forever on a dead stream.
+func (c *StateChannel) failPending(reason string) {
+	c.mu.Lock()
+	pending := c.responses
+	c.responses = make(map[string]chan<- *pb.StateResponse)
+	c.mu.Unlock()
 
+	for id, ch := range pending {
 		select {
-		case ch <- msg:
-			// ok
+		case ch <- &pb.StateResponse{Id: id, Error: reason}:
 		default:
-			panic(fmt.Sprintf("StateChannel[%v].read: failed to consume state response: %v", c.id, proto.MarshalTextString(msg)))
 		}
 	}
 }
 
+func (c *StateChannel) read(ctx context.Context, client pb.BeamFnState_StateClient, gen int64) {
+	for {
+		msg, err := client.Recv()
+		if err != nil {
+			if ctx.Err() != nil {
+				// The channel is shutting down: nothing will reconnect this
+				// stream, so tear down any waiter left behind rather than
+				// let it block forever.
+				c.failPending(stateChannelShutdown)
+				return
+			}
+			c.mu.Lock()
+			current := c.generation
+			c.mu.Unlock()
+			if current != gen {
+				// Stale: a write-triggered reconnect already replaced this
+				// stream with a new one, and that new read loop is already
+				// running. This Recv error just belongs to the old, now-
+				// abandoned stream catching up to its own teardown, so the
+				// requests still pending are registered against the healthy
+				// new stream -- failing them here would be wrong.
+				return
+			}
+
+			if err == io.EOF {
+				log.Warnf(ctx, "StateChannel[%v].read: closed, reconnecting", c.id)
+			} else {
+				log.Errorf(ctx, "StateChannel[%v].read bad, reconnecting: %v", c.id, err)
+			}
+			c.failPending(stateChannelDisconnected)
+			c.signalBroken(gen)
+			return
+		}
+
+		c.deliver(ctx, msg)
+	}
+}
+
+// deliver routes a response to the channel its waiter is listening on. It
+// never blocks and never panics: a response for a request no one is
+// waiting on anymore (e.g. Send timed out, or a prefetch was canceled) is
+// simply counted and logged at debug level, and the same happens if the
+// waiter's buffer is somehow already full.
+func (c *StateChannel) deliver(ctx context.Context, msg *pb.StateResponse) {
+	c.mu.Lock()
+	ch, ok := c.responses[msg.Id]
+	delete(c.responses, msg.Id)
+	c.mu.Unlock()
+	if !ok {
+		// This can happen if Send returns an error that write handles, but
+		// the message was actually sent.
+		atomic.AddInt64(&c.orphans, 1)
+		log.Debugf(ctx, "StateChannel[%v].read: no consumer for state response: %v", c.id, proto.MarshalTextString(msg))
+		return
+	}
+
+	select {
+	case ch <- msg:
+		// ok
+	default:
+		atomic.AddInt64(&c.orphans, 1)
+		log.Debugf(ctx, "StateChannel[%v].read: dropping unconsumed state response: %v", c.id, proto.MarshalTextString(msg))
+	}
+}
+
+// OrphanResponses returns the number of responses received for a request no
+// one was waiting on anymore, or dropped because the waiter's buffer was
+// already full, for diagnostics.
+func (c *StateChannel) OrphanResponses() int64 {
+	return atomic.LoadInt64(&c.orphans)
+}
+
 func (c *StateChannel) write(ctx context.Context) {
+	defer c.wg.Done()
+
 	for req := range c.requests {
-		err := c.client.Send(req)
+		c.mu.Lock()
+		client := c.client
+		gen := c.generation
+		c.mu.Unlock()
+
+		err := client.Send(req)
 		if err == nil {
 			continue // ok
 		}
 
-		// Failed to send. Return error.
+		// Failed to send: the stream is dead. Fail this request, signal the
+		// supervisor, and wait for it to reconnect before pulling the next
+		// queued request -- otherwise every request still in c.requests
+		// would be failed immediately against a client we already know is
+		// dead, for the whole backoff window.
+		c.failRequest(req.Id, stateChannelDisconnected)
+		c.signalBroken(gen)
+		c.awaitReconnect(ctx, gen)
+	}
+}
+
+// failRequest delivers a synthetic error response to the single request id,
+// if anyone is still waiting on it.
+func (c *StateChannel) failRequest(id string, reason string) {
+	c.mu.Lock()
+	ch, ok := c.responses[id]
+	delete(c.responses, id)
+	c.mu.Unlock()
+
+	if ok {
+		select {
+		case ch <- &pb.StateResponse{Id: id, Error: reason}:
+		default:
+		}
+	} // else ignore: already received a response due to a race
+}
+
+// awaitReconnect blocks until the channel has a stream newer than gen, or
+// ctx is done. write calls this after a failed Send so it waits out a
+// reconnect instead of spinning through the rest of the queue failing every
+// request against a connection it already knows is dead.
+func (c *StateChannel) awaitReconnect(ctx context.Context, gen int64) {
+	for {
 		c.mu.Lock()
-		ch, ok := c.responses[req.Id]
-		delete(c.responses, req.Id)
+		current := c.generation
+		ready := c.ready
 		c.mu.Unlock()
-
-		if ok {
-			ch <- &pb.StateResponse{Id: req.Id, Error: fmt.Sprintf("failed to send: %v", err)}
-		} // else ignore: already received response due to race
+		if current > gen {
+			return
+		}
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
-// Send sends a state request and returns the response.
-func (c *StateChannel) Send(req *pb.StateRequest) (*pb.StateResponse, error) {
+// sendAsync enqueues req and returns immediately with the channel its
+// response will arrive on and a cancel func. Callers that stop waiting on
+// the channel before a response arrives must call cancel to deregister it,
+// so a late response doesn't log as an orphan with no consumer.
+func (c *StateChannel) sendAsync(req *pb.StateRequest) (<-chan *pb.StateResponse, func()) {
 	id := fmt.Sprintf("r%v", atomic.AddInt32(&c.nextRequestNo, 1))
 	req.Id = id
 
-	ch := make(chan *pb.StateResponse, 1)
+	// Buffered for 2: a retried send (write failing, then the stream
+	// supervisor failing the same id again) must never block delivery.
+	ch := make(chan *pb.StateResponse, 2)
+
 	c.mu.Lock()
+	if c.closed {
+		// shutdown has already closed c.requests: a caller still holding
+		// this channel (a prefetchLoop retry, a not-yet-closed writer) must
+		// get a terminal error here instead of panicking on a send to a
+		// closed channel.
+		c.mu.Unlock()
+		ch <- &pb.StateResponse{Id: id, Error: stateChannelShutdown}
+		return ch, func() {}
+	}
 	c.responses[id] = ch
+	// Send while still holding c.mu, so this can't race shutdown closing
+	// c.requests between the closed check above and this send.
+	c.requests <- req
 	c.mu.Unlock()
 
-	c.requests <- req
+	cancel := func() {
+		c.mu.Lock()
+		delete(c.responses, id)
+		c.mu.Unlock()
+	}
+	return ch, cancel
+}
 
-	// TODO(herohde) 7/21/2018: time out?
-	resp := <-ch
-	if resp.Error != "" {
-		return nil, errors.New(resp.Error)
+// Send sends a state request and returns the response. It returns an error
+// if the request could not be delivered, the channel reported a disconnect
+// (see stateChannelDisconnected), or no response arrived within the
+// channel's send timeout.
+func (c *StateChannel) Send(req *pb.StateRequest) (*pb.StateResponse, error) {
+	c.mu.Lock()
+	timeout := c.sendTimeout
+	c.mu.Unlock()
+
+	ch, cancel := c.sendAsync(req)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case resp := <-ch:
+		if resp.Error != "" {
+			return nil, errors.New(resp.Error)
+		}
+		return resp, nil
+	case <-timer.C:
+		cancel()
+		return nil, errors.Errorf("StateChannel[%v]: request %v timed out after %v", c.id, req.Id, timeout)
 	}
-	return resp, nil
+}
+
+// shutdown tears the channel down for good: no further requests are
+// accepted, the underlying stream is closed, and every request still
+// pending fails with a terminal error. It is called by
+// StateChannelManager when the harness shuts a worker down, so this
+// channel's goroutines don't outlive it.
+func (c *StateChannel) shutdown() {
+	// closed is set, and requests closed, under the same lock sendAsync
+	// checks and sends under -- otherwise a sendAsync already past the
+	// closed check could still try to send on requests after it's closed
+	// here, and panic.
+	c.mu.Lock()
+	c.closed = true
+	close(c.requests)
+	c.mu.Unlock()
+
+	// Cancel before waiting: if write is parked in awaitReconnect because
+	// the stream is mid-reconnect, nothing else will ever wake it, and
+	// wg.Wait below would block forever. Canceling first also stops
+	// supervise and the active read loop.
+	c.cancel()
+	c.wg.Wait() // let write drain c.requests before the stream goes away
+
+	c.mu.Lock()
+	if c.cc != nil {
+		c.cc.Close()
+	}
+	c.mu.Unlock()
+
+	c.failPending(stateChannelShutdown)
 }
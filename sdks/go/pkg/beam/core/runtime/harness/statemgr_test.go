@@ -0,0 +1,690 @@
+// Licensed to the Apache Software Foundation (ASF) under one or more
+// contributor license agreements.  See the NOTICE file distributed with
+// this work for additional information regarding copyright ownership.
+// The ASF licenses this file to You under the Apache License, Version 2.0
+// (the "License"); you may not use this file except in compliance with
+// the License.  You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package harness
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apache/beam/sdks/go/pkg/beam/core/runtime/exec"
+	pb "github.com/apache/beam/sdks/go/pkg/beam/model/fnexecution_v1"
+)
+
+// fakeStateClient is a minimal pb.BeamFnState_StateClient for tests: it
+// embeds the interface so unused grpc.ClientStream methods are never
+// invoked, and implements Send/Recv directly against a StateChannel's
+// response delivery so callers of StateChannel.Send see a real round trip
+// without a live gRPC connection.
+type fakeStateClient struct {
+	pb.BeamFnState_StateClient
+
+	ch *StateChannel
+
+	mu      sync.Mutex
+	sent    []*pb.StateRequest
+	sendErr error
+	// sendFn, if set, fully replaces the default immediate-ack behavior:
+	// it is responsible for delivering (or not) a response itself.
+	sendFn func(*pb.StateRequest) error
+	// recvFn backs Recv, for tests that drive StateChannel.read directly.
+	recvFn func() (*pb.StateResponse, error)
+}
+
+func (f *fakeStateClient) Recv() (*pb.StateResponse, error) {
+	f.mu.Lock()
+	fn := f.recvFn
+	f.mu.Unlock()
+	return fn()
+}
+
+func (f *fakeStateClient) Send(req *pb.StateRequest) error {
+	f.mu.Lock()
+	f.sent = append(f.sent, req)
+	err := f.sendErr
+	fn := f.sendFn
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if fn != nil {
+		return fn(req)
+	}
+	// Acknowledge immediately, as if the runner replied right away.
+	go f.ch.deliver(context.Background(), &pb.StateResponse{Id: req.Id})
+	return nil
+}
+
+func (f *fakeStateClient) requests() []*pb.StateRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	out := make([]*pb.StateRequest, len(f.sent))
+	copy(out, f.sent)
+	return out
+}
+
+// rawTestChannel builds a StateChannel wired to a fake client, with write()
+// running but without dialing or supervising a real stream -- the tests
+// below exercise write/deliver/cache/prefetch logic directly rather than
+// the reconnect machinery, which needs a live gRPC endpoint. Callers own
+// the returned channel's teardown (either via shutdown() or by closing
+// requests and cancelling themselves).
+func rawTestChannel() (*StateChannel, *fakeStateClient) {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &StateChannel{
+		id:          "test",
+		sendTimeout: defaultStateSendTimeout,
+		requests:    make(chan *pb.StateRequest, 10),
+		responses:   make(map[string]chan<- *pb.StateResponse),
+		ready:       make(chan struct{}),
+		broken:      make(chan int64, 1),
+		cancel:      cancel,
+		generation:  1,
+	}
+	client := &fakeStateClient{ch: c}
+	c.client = client
+
+	c.wg.Add(1)
+	go c.write(ctx)
+	return c, client
+}
+
+// newTestChannel is rawTestChannel with teardown registered via t.Cleanup,
+// for tests that don't need to drive shutdown themselves.
+func newTestChannel(t *testing.T) (*StateChannel, *fakeStateClient) {
+	t.Helper()
+	c, client := rawTestChannel()
+	t.Cleanup(func() {
+		close(c.requests)
+		c.wg.Wait()
+		c.cancel()
+	})
+	return c, client
+}
+
+func testKey(t *testing.T) *pb.StateKey {
+	t.Helper()
+	return bagUserStateKey(exec.StreamID{PtransformID: "t1", Port: exec.Port{URL: "test"}}, "state1", []byte("key"), []byte("window"))
+}
+
+func TestStateCacheGetPutHitMiss(t *testing.T) {
+	c := newStateCache(defaultStateCacheBudget)
+	key := testKey(t)
+	token := []byte("tok1")
+
+	if _, ok := c.get(key, token); ok {
+		t.Fatalf("get on empty cache: got a hit, want a miss")
+	}
+
+	segs := [][]byte{[]byte("a"), []byte("b")}
+	c.put(key, token, segs)
+
+	got, ok := c.get(key, token)
+	if !ok {
+		t.Fatalf("get after put: got a miss, want a hit")
+	}
+	if len(got) != 2 || string(got[0]) != "a" || string(got[1]) != "b" {
+		t.Fatalf("get returned %v, want %v", got, segs)
+	}
+
+	if m := c.Metrics(); m.Hits != 1 || m.Misses != 1 {
+		t.Fatalf("Metrics() = %+v, want 1 hit and 1 miss", m)
+	}
+
+	// A different token for the same key is a distinct cache entry.
+	if _, ok := c.get(key, []byte("tok2")); ok {
+		t.Fatalf("get with a different token: got a hit, want a miss")
+	}
+
+	// No token (the runner didn't offer caching for this key) never hits.
+	if _, ok := c.get(key, nil); ok {
+		t.Fatalf("get with no token: got a hit, want a miss")
+	}
+}
+
+func TestStateCacheEvictsLeastRecentlyUsedByBudget(t *testing.T) {
+	// Budget only big enough for one 4-byte entry at a time.
+	c := newStateCache(4)
+	keyA := bagUserStateKey(exec.StreamID{PtransformID: "t1", Port: exec.Port{URL: "test"}}, "a", nil, nil)
+	keyB := bagUserStateKey(exec.StreamID{PtransformID: "t1", Port: exec.Port{URL: "test"}}, "b", nil, nil)
+
+	c.put(keyA, []byte("tok"), [][]byte{[]byte("aaaa")})
+	c.put(keyB, []byte("tok"), [][]byte{[]byte("bbbb")})
+
+	if _, ok := c.get(keyA, []byte("tok")); ok {
+		t.Fatalf("keyA should have been evicted to stay under budget")
+	}
+	if _, ok := c.get(keyB, []byte("tok")); !ok {
+		t.Fatalf("keyB should still be cached")
+	}
+}
+
+func TestStateCacheInvalidate(t *testing.T) {
+	c := newStateCache(defaultStateCacheBudget)
+	key := testKey(t)
+	token := []byte("tok1")
+	c.put(key, token, [][]byte{[]byte("a")})
+
+	c.invalidate(key, token)
+
+	if _, ok := c.get(key, token); ok {
+		t.Fatalf("get after invalidate: got a hit, want a miss")
+	}
+
+	// Invalidating a key/token pair that was never cached is a no-op, not
+	// an error.
+	c.invalidate(key, []byte("never-cached"))
+}
+
+func TestStateCacheUpdateTokensInvalidatesOnlySupersededScope(t *testing.T) {
+	c := newStateCache(defaultStateCacheBudget)
+	key := testKey(t)
+
+	userToken := CacheToken{Token: []byte("user-v1"), UserState: true}
+	sideToken := CacheToken{Token: []byte("side-v1"), SideInputTransformID: "t1", SideInputID: "s1"}
+
+	c.updateTokens([]CacheToken{userToken, sideToken})
+	c.put(key, userToken.Token, [][]byte{[]byte("a")})
+	c.put(key, sideToken.Token, [][]byte{[]byte("b")})
+
+	// A second bundle with a different token set for an unrelated scope
+	// (e.g. a side input the first bundle never mentioned) must not evict
+	// either of the above -- the cache is process-wide and bundles run
+	// concurrently.
+	otherSideToken := CacheToken{Token: []byte("side2-v1"), SideInputTransformID: "t2", SideInputID: "s2"}
+	c.updateTokens([]CacheToken{otherSideToken})
+
+	if _, ok := c.get(key, userToken.Token); !ok {
+		t.Fatalf("user state entry evicted by an unrelated bundle's token set")
+	}
+	if _, ok := c.get(key, sideToken.Token); !ok {
+		t.Fatalf("side input entry evicted by an unrelated bundle's token set")
+	}
+
+	// A renewed token for the SAME scope (the runner invalidated and
+	// reissued the user state token) must drop the entry cached under the
+	// old token.
+	userTokenV2 := CacheToken{Token: []byte("user-v2"), UserState: true}
+	c.updateTokens([]CacheToken{userTokenV2})
+
+	if _, ok := c.get(key, userToken.Token); ok {
+		t.Fatalf("entry for the superseded user state token should have been evicted")
+	}
+	if _, ok := c.get(key, sideToken.Token); !ok {
+		t.Fatalf("side input entry should be unaffected by the user state token changing")
+	}
+}
+
+func TestStateKeyWriterBuffersUntilFlush(t *testing.T) {
+	ch, client := newTestChannel(t)
+	w := newBagUserStateWriter(ch, exec.StreamID{PtransformID: "t1", Port: exec.Port{URL: "test"}}, "state1", "inst1", []byte("key"), nil)
+
+	if _, err := w.Write([]byte("hello ")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, err := w.Write([]byte("world")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if len(client.requests()) != 0 {
+		t.Fatalf("Write sent %d requests, want 0 (buffered until flush)", len(client.requests()))
+	}
+
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	reqs := client.requests()
+	if len(reqs) != 1 {
+		t.Fatalf("got %d requests after Flush, want 1", len(reqs))
+	}
+	got := reqs[0].GetAppend().GetData()
+	if string(got) != "hello world" {
+		t.Fatalf("appended data = %q, want %q", got, "hello world")
+	}
+
+	// A Flush with nothing buffered is a no-op: no extra request.
+	if err := w.Flush(); err != nil {
+		t.Fatalf("second Flush: %v", err)
+	}
+	if len(client.requests()) != 1 {
+		t.Fatalf("empty Flush sent a request, want none")
+	}
+}
+
+func TestStateKeyWriterCloseIsIdempotentAndFlushesOnce(t *testing.T) {
+	ch, client := newTestChannel(t)
+	w := newBagUserStateWriter(ch, exec.StreamID{PtransformID: "t1", Port: exec.Port{URL: "test"}}, "state1", "inst1", []byte("key"), nil)
+
+	if _, err := w.Write([]byte("x")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+	if len(client.requests()) != 1 {
+		t.Fatalf("got %d append requests across two Close calls, want 1", len(client.requests()))
+	}
+	if _, err := w.Write([]byte("y")); err == nil {
+		t.Fatalf("Write after Close: got nil error, want one")
+	}
+}
+
+func TestStateKeyWriterFlushInvalidatesCache(t *testing.T) {
+	ch, _ := newTestChannel(t)
+	cache := newStateCache(defaultStateCacheBudget)
+	token := []byte("tok1")
+
+	w := newBagUserStateWriter(ch, exec.StreamID{PtransformID: "t1", Port: exec.Port{URL: "test"}}, "state1", "inst1", []byte("key"), nil)
+	w.cache = cache
+	w.cacheToken = token
+
+	// Seed the cache as if a prior read in this bundle had populated it.
+	cache.put(w.key, token, [][]byte{[]byte("stale")})
+
+	if _, err := w.Write([]byte("fresh")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	if _, ok := cache.get(w.key, token); ok {
+		t.Fatalf("cache entry survived a flush; a later read would see stale pre-append data")
+	}
+}
+
+func TestStateKeyReaderPrefetchPipelinesSegments(t *testing.T) {
+	ch, client := newTestChannel(t)
+	r := newRunnerReader(ch, "inst1", []byte("key"))
+
+	// Script the fake client's Send to answer each StateGetRequest in turn
+	// with a scripted Get response instead of the default empty ack, so
+	// Read pulls a real two-segment continuation chain through the
+	// prefetcher.
+	var n int32
+	client.mu.Lock()
+	client.sendFn = func(req *pb.StateRequest) error {
+		n++
+		var resp *pb.StateResponse
+		switch n {
+		case 1:
+			resp = &pb.StateResponse{Id: req.Id, Response: &pb.StateResponse_Get{Get: &pb.StateGetResponse{Data: []byte("seg1"), ContinuationToken: []byte("cont")}}}
+		case 2:
+			resp = &pb.StateResponse{Id: req.Id, Response: &pb.StateResponse_Get{Get: &pb.StateGetResponse{Data: []byte("seg2")}}}
+		default:
+			resp = &pb.StateResponse{Id: req.Id}
+		}
+		go ch.deliver(context.Background(), resp)
+		return nil
+	}
+	client.mu.Unlock()
+
+	buf := make([]byte, 4)
+	n1, err := r.Read(buf)
+	if err != nil {
+		t.Fatalf("first Read: %v", err)
+	}
+	if string(buf[:n1]) != "seg1" {
+		t.Fatalf("first Read = %q, want %q", buf[:n1], "seg1")
+	}
+
+	n2, err := r.Read(buf)
+	if err != nil {
+		t.Fatalf("second Read: %v", err)
+	}
+	if string(buf[:n2]) != "seg2" {
+		t.Fatalf("second Read = %q, want %q", buf[:n2], "seg2")
+	}
+
+	if _, err := r.Read(buf); err != io.EOF {
+		t.Fatalf("third Read error = %v, want io.EOF", err)
+	}
+
+	r.Close()
+}
+
+func TestStateKeyReaderCloseBeforeReadNeverLeaksOrPanics(t *testing.T) {
+	ch, _ := newTestChannel(t)
+	r := newRunnerReader(ch, "inst1", []byte("key"))
+
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	// A prefetch that starts after Close must not be launched, and Read
+	// must fail cleanly rather than block forever on a fetcher that will
+	// never run.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, _ = r.Read(make([]byte, 1))
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Read after Close did not return; startPrefetch likely raced with Close")
+	}
+}
+
+func TestStateKeyReaderReadUnblocksWhenCloseRacesInFlightFetch(t *testing.T) {
+	ch, client := newTestChannel(t)
+	r := newRunnerReader(ch, "inst1", []byte("key"))
+
+	// Never ack the Get: fetchOne's respCh is left waiting forever, so the
+	// only way prefetchLoop ever returns is via prefetchDone firing.
+	client.mu.Lock()
+	client.sendFn = func(req *pb.StateRequest) error { return nil }
+	client.mu.Unlock()
+
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		_, _ = r.Read(make([]byte, 1))
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for len(client.requests()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	// Close races the in-flight fetch: prefetchLoop is blocked in fetchOne
+	// waiting on a response that will never come, and has not yet sent
+	// anything on r.prefetch.
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	select {
+	case <-readDone:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Read did not unblock when Close raced its in-flight fetch; see chunk0-4 Read/prefetch race fix")
+	}
+}
+
+func TestStateKeyReaderCloseConcurrentWithStartPrefetch(t *testing.T) {
+	ch, _ := newTestChannel(t)
+	r := newRunnerReader(ch, "inst1", []byte("key"))
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, _, _ = r.startPrefetch(ch)
+	}()
+	go func() {
+		defer wg.Done()
+		_ = r.Close()
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("startPrefetch/Close did not both return; see chunk0-4 race fix")
+	}
+}
+
+func TestSignalBrokenKeepsOnlyFreshestGeneration(t *testing.T) {
+	ch, _ := newTestChannel(t)
+
+	ch.signalBroken(1)
+	ch.signalBroken(2) // must replace, not be dropped behind, generation 1
+
+	select {
+	case gen := <-ch.broken:
+		if gen != 2 {
+			t.Fatalf("broken carried generation %d, want 2", gen)
+		}
+	default:
+		t.Fatalf("broken channel empty, want a pending generation 2 signal")
+	}
+
+	select {
+	case gen := <-ch.broken:
+		t.Fatalf("unexpected extra signal for generation %d", gen)
+	default:
+	}
+}
+
+func TestJitterStaysWithinHalfOpenBound(t *testing.T) {
+	d := 100 * time.Millisecond
+	for i := 0; i < 100; i++ {
+		got := jitter(d)
+		if got < d/2 || got >= d {
+			t.Fatalf("jitter(%v) = %v, want in [%v, %v)", d, got, d/2, d)
+		}
+	}
+	if got := jitter(0); got != 0 {
+		t.Fatalf("jitter(0) = %v, want 0", got)
+	}
+}
+
+func TestAwaitReconnectUnblocksOnNewGeneration(t *testing.T) {
+	ch, _ := newTestChannel(t)
+
+	done := make(chan struct{})
+	go func() {
+		ch.awaitReconnect(context.Background(), 1)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatalf("awaitReconnect returned before the generation advanced")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ch.mu.Lock()
+	ch.generation = 2
+	ready := ch.ready
+	ch.ready = make(chan struct{})
+	ch.mu.Unlock()
+	close(ready)
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("awaitReconnect did not unblock after generation advanced past the watched one")
+	}
+}
+
+func TestStateChannelReadIgnoresStaleGenerationDisconnect(t *testing.T) {
+	ch, client := rawTestChannel()
+	defer func() {
+		close(ch.requests)
+		ch.wg.Wait()
+		ch.cancel()
+	}()
+
+	// A request registered against the current, healthy stream at
+	// generation 2.
+	respCh := make(chan *pb.StateResponse, 1)
+	ch.mu.Lock()
+	ch.generation = 2
+	ch.responses["r1"] = respCh
+	ch.mu.Unlock()
+
+	client.mu.Lock()
+	client.recvFn = func() (*pb.StateResponse, error) { return nil, errors.New("old stream Recv error") }
+	client.mu.Unlock()
+
+	// read(gen=1) is the old stream's loop, only now catching up to the
+	// fact that connect already replaced it with generation 2.
+	ch.read(context.Background(), client, 1)
+
+	select {
+	case resp := <-respCh:
+		t.Fatalf("stale read loop wrongly failed a request pending on the current stream: %v", resp)
+	default:
+	}
+	select {
+	case gen := <-ch.broken:
+		t.Fatalf("stale read loop wrongly signaled broken for generation %d", gen)
+	default:
+	}
+}
+
+func TestDeliverToUnknownIDIsCountedNotPanicked(t *testing.T) {
+	ch, _ := newTestChannel(t)
+	ch.deliver(context.Background(), &pb.StateResponse{Id: "no-such-request"})
+	if got := ch.OrphanResponses(); got != 1 {
+		t.Fatalf("OrphanResponses() = %d, want 1", got)
+	}
+}
+
+func TestStateKeyWriterCloseFlushesBeforeReturning(t *testing.T) {
+	ch, client := newTestChannel(t)
+	w := newBagUserStateWriter(ch, exec.StreamID{PtransformID: "t1", Port: exec.Port{URL: "test"}}, "state1", "inst1", []byte("key"), nil)
+	if _, err := w.Write([]byte("last")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := w.Close(); err != nil {
+			t.Errorf("Close: %v", err)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("writer Close did not complete")
+	}
+
+	if len(client.requests()) != 1 {
+		t.Fatalf("got %d requests, want the final buffered append to have been sent", len(client.requests()))
+	}
+}
+
+func TestStateChannelShutdownFailsPendingRequests(t *testing.T) {
+	ch, client := rawTestChannel()
+	client.mu.Lock()
+	client.sendFn = func(req *pb.StateRequest) error { return nil } // swallow: never ack
+	client.mu.Unlock()
+
+	respCh, cancel := ch.sendAsync(&pb.StateRequest{InstructionId: "inst1"})
+	defer cancel()
+
+	// Give write() a chance to actually send before tearing the channel
+	// down, so the request is genuinely pending.
+	deadline := time.Now().Add(time.Second)
+	for len(client.requests()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ch.shutdown()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("shutdown did not complete")
+	}
+
+	select {
+	case resp := <-respCh:
+		if resp.Error != stateChannelShutdown {
+			t.Fatalf("pending request failed with %q, want %q", resp.Error, stateChannelShutdown)
+		}
+	default:
+		t.Fatalf("pending request was never failed by shutdown")
+	}
+}
+
+func TestStateChannelShutdownUnblocksWriteStuckInAwaitReconnect(t *testing.T) {
+	ch, client := rawTestChannel()
+	client.mu.Lock()
+	client.sendErr = errors.New("send fails: stream is dead")
+	client.mu.Unlock()
+
+	// write() picks this up, fails the send, and parks in awaitReconnect --
+	// rawTestChannel runs no supervise goroutine, so nothing will ever
+	// advance the generation or close ready. shutdown is the only way out.
+	respCh, cancel := ch.sendAsync(&pb.StateRequest{InstructionId: "inst1"})
+	defer cancel()
+
+	deadline := time.Now().Add(time.Second)
+	for len(client.requests()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ch.shutdown()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("shutdown did not unblock write stuck in awaitReconnect; see chunk0-3 shutdown ordering fix")
+	}
+
+	select {
+	case resp := <-respCh:
+		if resp.Error != stateChannelDisconnected {
+			t.Fatalf("pending request failed with %q, want %q", resp.Error, stateChannelDisconnected)
+		}
+	default:
+		t.Fatalf("pending request was never failed")
+	}
+}
+
+func TestSendAsyncAfterShutdownFailsInsteadOfPanicking(t *testing.T) {
+	ch, _ := rawTestChannel()
+
+	done := make(chan struct{})
+	go func() {
+		ch.shutdown()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("shutdown did not complete")
+	}
+
+	// A caller still holding the channel after shutdown -- e.g. a
+	// prefetchLoop retry, or a writer not yet closed -- must get a
+	// terminal error, not a panic on a send to the now-closed requests
+	// channel.
+	respCh, cancel := ch.sendAsync(&pb.StateRequest{InstructionId: "inst1"})
+	defer cancel()
+
+	select {
+	case resp := <-respCh:
+		if resp.Error != stateChannelShutdown {
+			t.Fatalf("sendAsync after shutdown failed with %q, want %q", resp.Error, stateChannelShutdown)
+		}
+	default:
+		t.Fatalf("sendAsync after shutdown did not deliver a response")
+	}
+}